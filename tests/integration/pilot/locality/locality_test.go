@@ -0,0 +1,242 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locality
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"istio.io/istio/pkg/test/framework"
+	"istio.io/istio/pkg/test/framework/components/echo"
+	"istio.io/istio/pkg/test/framework/components/namespace"
+)
+
+// trafficShareTolerance is the allowed deviation, in percentage points,
+// between the configured and observed traffic share for a given backend
+// over sendCount requests.
+const trafficShareTolerance = 10
+
+// sendTrafficAndTally calls host sendCount times from from and returns, for
+// each of services, the percentage (0-100) of responses whose hostname
+// belongs to that service. Response hostnames are pod hostnames (e.g. "b-7d9f6b5c8-x2abc"),
+// so membership is determined by the "<service>-" prefix rather than an
+// exact match against the service name.
+func sendTrafficAndTally(from echo.Instance, host string, services ...string) (map[string]float64, error) {
+	headers := http.Header{}
+	headers.Add("Host", host)
+	resp, err := from.Call(echo.CallOptions{
+		Target:   from,
+		PortName: "http",
+		Headers:  headers,
+		Count:    sendCount,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, r := range resp {
+		for _, svc := range services {
+			if strings.HasPrefix(r.Hostname, svc+"-") {
+				counts[svc]++
+				break
+			}
+		}
+	}
+	shares := make(map[string]float64, len(counts))
+	for svc, count := range counts {
+		shares[svc] = float64(count) / float64(len(resp)) * 100
+	}
+	return shares, nil
+}
+
+func assertTrafficShare(t *testing.T, shares map[string]float64, service string, want float64) {
+	t.Helper()
+	got := shares[service]
+	if got < want-trafficShareTolerance || got > want+trafficShareTolerance {
+		t.Errorf("traffic share for %s: got %.1f%%, want %.1f%% (+/- %d)", service, got, want, trafficShareTolerance)
+	}
+}
+
+// TestLocalityDistribute verifies a weighted distribute setting splits
+// traffic across localities roughly according to the configured weights,
+// rather than failing over all-or-nothing.
+func TestLocalityDistribute(t *testing.T) {
+	framework.NewTest(t).
+		RunWithContext(func(ctx framework.TestContext) {
+			ctx.Parallel()
+			ns := namespace.NewOrFail(t, ctx, namespace.Config{Prefix: "locality-distribute"})
+
+			var client, b, c echo.Instance
+			echo.NewBuilder(ctx).
+				With(&client, echoConfig(ns, "client")).
+				With(&b, echoConfig(ns, "b")).
+				With(&c, echoConfig(ns, "c")).
+				BuildOrFail(t)
+
+			se := serviceConfig{
+				Name:             "fake-service-distribute",
+				Host:             "fake.service.distribute.istio.io",
+				Namespace:        ns.Name(),
+				Resolution:       "STATIC",
+				ServiceBAddress:  b.Address(),
+				ServiceBLocality: "region/zone/subzone",
+				ServiceCAddress:  c.Address(),
+				ServiceCLocality: "region/zone2/subzone",
+				Distribute: []LocalityWeight{
+					{From: "region/*", To: map[string]int{"region/zone/*": 70, "region/zone2/*": 30}},
+				},
+			}
+			deploy(ctx, ns, se, client, map[string]LocalityEndpointExpectation{
+				"region/zone/subzone":  {Count: 1, Priority: 0},
+				"region/zone2/subzone": {Count: 1, Priority: 0},
+			})
+
+			shares, err := sendTrafficAndTally(client, se.Host, b.Config().Service, c.Config().Service)
+			if err != nil {
+				t.Fatalf("traffic failed: %v", err)
+			}
+			assertTrafficShare(t, shares, b.Config().Service, 70)
+			assertTrafficShare(t, shares, c.Config().Service, 30)
+		})
+}
+
+// TestLocalityFailoverPriority verifies that, with a label-based
+// failoverPriority, traffic prefers the endpoint matching the highest
+// priority label before falling back to locality failover.
+func TestLocalityFailoverPriority(t *testing.T) {
+	framework.NewTest(t).
+		RunWithContext(func(ctx framework.TestContext) {
+			ctx.Parallel()
+			ns := namespace.NewOrFail(t, ctx, namespace.Config{Prefix: "locality-failover-priority"})
+
+			var client, b, c echo.Instance
+			echo.NewBuilder(ctx).
+				With(&client, echoConfig(ns, "client")).
+				With(&b, echoConfig(ns, "b")).
+				With(&c, echoConfig(ns, "c")).
+				BuildOrFail(t)
+
+			se := serviceConfig{
+				Name:             "fake-service-failover-priority",
+				Host:             "fake.service.failoverpriority.istio.io",
+				Namespace:        ns.Name(),
+				Resolution:       "STATIC",
+				// b matches the client's region and zone, c only matches
+				// the region, so failoverPriority should send all traffic
+				// to b even though neither is in the client's exact
+				// locality (region/zone/subzone).
+				ServiceBAddress:  b.Address(),
+				ServiceBLocality: "region/zone/subzone2",
+				ServiceCAddress:  c.Address(),
+				ServiceCLocality: "region/zone2/subzone2",
+				FailoverPriority: []string{
+					"topology.kubernetes.io/region",
+					"topology.kubernetes.io/zone",
+				},
+			}
+			deploy(ctx, ns, se, client, map[string]LocalityEndpointExpectation{
+				"region/zone/subzone2":  {Count: 1, Priority: 0},
+				"region/zone2/subzone2": {Count: 1, Priority: 1},
+			})
+
+			shares, err := sendTrafficAndTally(client, se.Host, b.Config().Service, c.Config().Service)
+			if err != nil {
+				t.Fatalf("traffic failed: %v", err)
+			}
+			assertTrafficShare(t, shares, b.Config().Service, 100)
+		})
+}
+
+// TestLocalityWarmup verifies that an endpoint added to an existing
+// locality while warmupDurationSecs is in effect receives a ramped-up
+// (below its steady-state) share of traffic immediately after it joins,
+// and its full share once the warmup window has elapsed.
+func TestLocalityWarmup(t *testing.T) {
+	framework.NewTest(t).
+		RunWithContext(func(ctx framework.TestContext) {
+			ctx.Parallel()
+			ns := namespace.NewOrFail(t, ctx, namespace.Config{Prefix: "locality-warmup"})
+
+			var client, b, c echo.Instance
+			echo.NewBuilder(ctx).
+				With(&client, echoConfig(ns, "client")).
+				With(&b, echoConfig(ns, "b")).
+				With(&c, echoConfig(ns, "c")).
+				BuildOrFail(t)
+
+			const (
+				warmupDurationSecs = 30
+				// warmupMargin is added past the warmup boundary before
+				// sampling steady state, so a slow EDS push doesn't leave the
+				// newly joined endpoint still ramping when we sample.
+				warmupMargin = 10 * time.Second
+			)
+
+			// Deploy with only b in the locality (via the ServiceCAddress slot,
+			// which is mandatory) so it is the sole, already-warm endpoint;
+			// leave ServiceBAddress unset so there's exactly one lbEndpoint.
+			se := serviceConfig{
+				Name:               "fake-service-warmup",
+				Host:               "fake.service.warmup.istio.io",
+				Namespace:          ns.Name(),
+				Resolution:         "STATIC",
+				ServiceCAddress:    b.Address(),
+				ServiceCLocality:   "region/zone/subzone",
+				WarmupDurationSecs: warmupDurationSecs,
+			}
+			deploy(ctx, ns, se, client, map[string]LocalityEndpointExpectation{
+				"region/zone/subzone": {Count: 1, Priority: 0},
+			})
+
+			// Add c to the same locality via the now-filled ServiceBAddress
+			// slot. Envoy should ramp its weight up from zero rather than
+			// immediately splitting traffic 50/50. joinTime anchors the
+			// warmup window to when c actually joined, rather than to
+			// whenever this goroutine happens to resume after convergence.
+			joinTime := time.Now()
+			se.ServiceBAddress = c.Address()
+			se.ServiceBLocality = "region/zone/subzone"
+			deploy(ctx, ns, se, client, map[string]LocalityEndpointExpectation{
+				"region/zone/subzone": {Count: 2, Priority: 0},
+			})
+
+			if remaining := warmupDurationSecs*time.Second - time.Since(joinTime); remaining > 0 {
+				rampedShares, err := sendTrafficAndTally(client, se.Host, b.Config().Service, c.Config().Service)
+				if err != nil {
+					t.Fatalf("traffic failed: %v", err)
+				}
+				if rampedShares[c.Config().Service] >= 50-trafficShareTolerance {
+					t.Errorf("newly joined endpoint %s already at steady-state share during warmup: got %.1f%%",
+						c.Config().Service, rampedShares[c.Config().Service])
+				}
+			} else {
+				t.Logf("EDS convergence alone consumed the warmup window; skipping the during-warmup sample")
+			}
+
+			if remaining := warmupDurationSecs*time.Second + warmupMargin - time.Since(joinTime); remaining > 0 {
+				time.Sleep(remaining)
+			}
+
+			steadyShares, err := sendTrafficAndTally(client, se.Host, b.Config().Service, c.Config().Service)
+			if err != nil {
+				t.Fatalf("traffic failed: %v", err)
+			}
+			assertTrafficShare(t, steadyShares, b.Config().Service, 50)
+			assertTrafficShare(t, steadyShares, c.Config().Service, 50)
+		})
+}
@@ -15,26 +15,21 @@
 package locality
 
 import (
-	"bytes"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"regexp"
+	"strings"
 	"testing"
-	"text/template"
 	"time"
 
 	envoyAdmin "github.com/envoyproxy/go-control-plane/envoy/admin/v2alpha"
 
 	"istio.io/istio/pkg/config/protocol"
-	"istio.io/istio/pkg/test"
 	"istio.io/istio/pkg/test/framework"
 	"istio.io/istio/pkg/test/framework/components/echo"
 	"istio.io/istio/pkg/test/framework/components/environment"
-	"istio.io/istio/pkg/test/framework/components/galley"
 	"istio.io/istio/pkg/test/framework/components/istio"
 	"istio.io/istio/pkg/test/framework/components/namespace"
-	"istio.io/istio/pkg/test/framework/components/pilot"
 	"istio.io/istio/pkg/test/framework/label"
 	"istio.io/istio/pkg/test/framework/resource"
 	"istio.io/istio/pkg/test/util/retry"
@@ -66,8 +61,10 @@ spec:
   - address: {{.NonExistantService}}
     locality: {{.NonExistantServiceLocality}}
   {{ end }}
+  {{ if ne .ServiceBAddress "" }}
   - address: {{.ServiceBAddress}}
     locality: {{.ServiceBLocality}}
+  {{ end }}
   - address: {{.ServiceCAddress}}
     locality: {{.ServiceCLocality}}
 ---
@@ -99,9 +96,28 @@ spec:
     loadBalancer:
       simple: ROUND_ROBIN
       localityLbSetting:
+        {{ if .Distribute }}
+        distribute:
+        {{ range .Distribute }}
+        - from: {{.From}}
+          to:
+            {{ range $locality, $weight := .To }}
+            {{$locality}}: {{$weight}}
+            {{ end }}
+        {{ end }}
+        {{ else if .FailoverPriority }}
+        failoverPriority:
+        {{ range .FailoverPriority }}
+        - {{.}}
+        {{ end }}
+        {{ else }}
         failover:
         - from: region
           to: closeregion
+        {{ end }}
+      {{ if .WarmupDurationSecs }}
+      warmupDurationSecs: {{.WarmupDurationSecs}}s
+      {{ end }}
     outlierDetection:
       consecutiveErrors: 100
       interval: 1s
@@ -111,45 +127,31 @@ spec:
 )
 
 var (
-	bHostnameMatcher   = regexp.MustCompile("^b-.*$")
-	deploymentTemplate *template.Template
+	bHostnameMatcher = regexp.MustCompile("^b-.*$")
 
 	ist istio.Instance
-	p   pilot.Instance
-	g   galley.Instance
-	r   *rand.Rand
 )
 
-func init() {
-	var err error
-	deploymentTemplate, err = template.New("localityTemplate").Parse(deploymentYAML)
-	if err != nil {
-		panic(err)
-	}
-}
-
 func TestMain(m *testing.M) {
 	framework.NewSuite("locality_prioritized_failover_loadbalancing", m).
 		Label(label.CustomSetup).
 		SetupOnEnv(environment.Kube, istio.Setup(&ist, nil)).
-		Setup(func(ctx resource.Context) (err error) {
-			if g, err = galley.New(ctx, galley.Config{}); err != nil {
-				return err
-			}
-			if p, err = pilot.New(ctx, pilot.Config{Galley: g}); err != nil {
-				return err
-			}
-			r = rand.New(rand.NewSource(time.Now().UnixNano()))
-			return nil
-		}).
 		Run()
 }
 
 func echoConfig(ns namespace.Instance, name string) echo.Config {
+	return echoConfigInCluster(ns, name, ist.Clusters().Default())
+}
+
+// echoConfigInCluster builds the echo.Config for name in the given cluster,
+// letting multi-cluster suites deploy distinct locality-labeled endpoints
+// per cluster.
+func echoConfigInCluster(ns namespace.Instance, name string, c resource.Cluster) echo.Config {
 	return echo.Config{
 		Service:   name,
 		Namespace: ns,
 		Locality:  "region.zone.subzone",
+		Cluster:   c,
 		Ports: []echo.Port{
 			{
 				Name:        "http",
@@ -157,11 +159,18 @@ func echoConfig(ns namespace.Instance, name string) echo.Config {
 				ServicePort: 80,
 			},
 		},
-		Galley: g,
-		Pilot:  p,
 	}
 }
 
+// LocalityWeight mirrors a networking.istio.io LocalityLoadBalancerSetting_Distribute
+// entry: the percentage of traffic from From is split across the localities
+// (and/or locality prefixes) in To, keyed by locality string and weighted by
+// percentage.
+type LocalityWeight struct {
+	From string
+	To   map[string]int
+}
+
 type serviceConfig struct {
 	Name                       string
 	Host                       string
@@ -173,19 +182,36 @@ type serviceConfig struct {
 	ServiceCLocality           string
 	NonExistantService         string
 	NonExistantServiceLocality string
+
+	// Distribute, FailoverPriority and WarmupDurationSecs parameterize the
+	// DestinationRule's localityLbSetting so a single template can drive
+	// prioritized-failover (the default, when Distribute and
+	// FailoverPriority are both empty),
+	// weighted-distribute, label-based failoverPriority, and slow-start
+	// warmup scenarios.
+	Distribute         []LocalityWeight
+	FailoverPriority   []string
+	WarmupDurationSecs int
 }
 
-func deploy(t test.Failer, ns namespace.Instance, se serviceConfig, from echo.Instance) {
-	t.Helper()
-	var buf bytes.Buffer
-	if err := deploymentTemplate.Execute(&buf, se); err != nil {
-		t.Fatal(err)
-	}
-	g.ApplyConfigOrFail(t, ns, buf.String())
+// deploy applies se to ns using ctx.ConfigIstio(), which templates and
+// applies it to every cluster in the test and cleans it up automatically
+// at the end of the (sub)test, then waits for from to see the resulting
+// route. If expectLocalities is non-empty, deploy additionally blocks on
+// WaitUntilLocalityConfig so that EDS has converged on those localities
+// before returning, giving callers a deterministic barrier before they
+// send traffic.
+func deploy(ctx framework.TestContext, ns namespace.Instance, se serviceConfig, from echo.Instance, expectLocalities map[string]LocalityEndpointExpectation) {
+	ctx.Helper()
+	ctx.ConfigIstio().Eval(ns.Name(), se, deploymentYAML).ApplyOrFail(ctx)
 
-	err := WaitUntilRoute(from, se.Host)
-	if err != nil {
-		t.Fatalf("Failed to get expected route: %v", err)
+	if err := WaitUntilRoute(from, se.Host); err != nil {
+		ctx.Fatalf("Failed to get expected route: %v", err)
+	}
+	if len(expectLocalities) > 0 {
+		if err := WaitUntilLocalityConfig(from, se.Host, expectLocalities); err != nil {
+			ctx.Fatalf("Failed to converge on expected locality config: %v", err)
+		}
 	}
 }
 
@@ -207,6 +233,8 @@ func WaitUntilRoute(c echo.Instance, dest string) error {
 		return true, nil
 	}
 
+	// c.Workloads() already spans every cluster c is deployed to, so this
+	// naturally covers primary-primary and primary-remote topologies.
 	workloads, _ := c.Workloads()
 	// Wait for the outbound config to be received by each workload from Pilot.
 	for _, w := range workloads {
@@ -220,6 +248,76 @@ func WaitUntilRoute(c echo.Instance, dest string) error {
 	return nil
 }
 
+// LocalityEndpointExpectation is what WaitUntilLocalityConfig requires a
+// single region/zone/subzone locality's ClusterLoadAssignment to look like:
+// Count lbEndpoints at the given Priority. Priority is what actually
+// distinguishes a local locality from one only reachable via
+// localityLbSetting.failover, so it is asserted alongside the count.
+type LocalityEndpointExpectation struct {
+	Count    int
+	Priority int
+}
+
+// WaitUntilLocalityConfig waits until every workload backing c has received
+// EDS endpoints for dest, one ClusterLoadAssignment locality per key of
+// expected, with the expected endpoint count and priority in that locality.
+// Unlike WaitUntilRoute, which only confirms CDS/RDS convergence, this also
+// waits on EDS so that locality failover tests have a deterministic barrier
+// before sendTraffic fires instead of racing Pilot's xDS push.
+//
+// expected keys are "region/zone/subzone" locality strings, matching the
+// locality format used by localityLbSetting.failover.
+func WaitUntilLocalityConfig(c echo.Instance, dest string, expected map[string]LocalityEndpointExpectation) error {
+	clusterName := fmt.Sprintf("outbound|%d||%s", 80, dest)
+
+	accept := func(cfg *envoyAdmin.ConfigDump) (bool, error) {
+		validator := structpath.ForProto(cfg)
+		// RDS: the virtual host for dest must be present.
+		if err := validator.
+			Exists("{.configs[*].dynamicRouteConfigs[*].routeConfig.virtualHosts[?(@.name == '%s')]}", dest+":80").
+			Check(); err != nil {
+			return false, err
+		}
+		// CDS: the cluster for dest must be active.
+		if err := validator.
+			Exists("{.configs[*].dynamicActiveClusters[?(@.cluster.name == '%s')]}", clusterName).
+			Check(); err != nil {
+			return false, err
+		}
+		// EDS: each expected locality must have the expected endpoint count
+		// and priority, the latter being what actually distinguishes a
+		// local locality from one only reachable via failover.
+		for locality, want := range expected {
+			parts := strings.Split(locality, "/")
+			if len(parts) != 3 {
+				return false, fmt.Errorf("locality %q must be of the form region/zone/subzone", locality)
+			}
+			region, zone, subzone := parts[0], parts[1], parts[2]
+			if err := validator.
+				Select("{.configs[*].dynamicEndpointConfigs[?(@.endpointConfig.clusterName == '%s')].endpointConfig}", clusterName).
+				Select("{.endpoints[?(@.locality.region == '%s' && @.locality.zone == '%s' && @.locality.subZone == '%s')]}",
+					region, zone, subzone).
+				Equals(float64(want.Count), "{.lbEndpoints.length()}").
+				Equals(float64(want.Priority), "{.priority}").
+				Check(); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	workloads, _ := c.Workloads()
+	for _, w := range workloads {
+		if w.Sidecar() != nil {
+			if err := w.Sidecar().WaitForConfig(accept, retry.Timeout(time.Second*30)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func sendTraffic(from echo.Instance, host string) error {
 	headers := http.Header{}
 	headers.Add("Host", host)
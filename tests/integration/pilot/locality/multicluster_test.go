@@ -0,0 +1,116 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locality
+
+import (
+	"net/http"
+	"testing"
+
+	"istio.io/istio/pkg/test/framework"
+	"istio.io/istio/pkg/test/framework/components/echo"
+	"istio.io/istio/pkg/test/framework/components/namespace"
+	"istio.io/istio/pkg/test/framework/label"
+)
+
+// assertAllTrafficReachedCluster calls host sendCount times from from and
+// fails the test unless every response came from a workload running in
+// wantCluster, so callers can tell which physical cluster actually served
+// the traffic instead of only checking the shared "b" service hostname.
+func assertAllTrafficReachedCluster(t *testing.T, from echo.Instance, host, wantCluster string) {
+	t.Helper()
+	headers := http.Header{}
+	headers.Add("Host", host)
+	resp, err := from.Call(echo.CallOptions{
+		Target:   from,
+		PortName: "http",
+		Headers:  headers,
+		Count:    sendCount,
+	})
+	if err != nil {
+		t.Fatalf("%s->%s failed sending: %v", from.Config().Service, host, err)
+	}
+	if len(resp) != sendCount {
+		t.Fatalf("%s->%s expected %d responses, received %d", from.Config().Service, host, sendCount, len(resp))
+	}
+	for i, r := range resp {
+		if r.Cluster != wantCluster {
+			t.Fatalf("%s->%s request[%d] was served by cluster %s, want %s", from.Config().Service, host, i, r.Cluster, wantCluster)
+		}
+	}
+}
+
+// TestMultiClusterLocalityFailover deploys a client and two "b" endpoints,
+// one per cluster, and verifies that a client in clusterA only fails over
+// to clusterB once the in-cluster endpoint is actually removed from the
+// ServiceEntry. It covers both the primary-primary (two independent control
+// planes) and primary-remote (single control plane, remote data plane)
+// topologies, since in both cases ctx.Clusters() returns more than one
+// cluster.
+func TestMultiClusterLocalityFailover(t *testing.T) {
+	framework.NewTest(t).
+		Label(label.Multicluster).
+		RunWithContext(func(ctx framework.TestContext) {
+			ctx.Parallel()
+			clusters := ctx.Clusters()
+			if len(clusters) < 2 {
+				ctx.Skip("test requires at least two clusters")
+			}
+			clusterA, clusterB := clusters[0], clusters[1]
+
+			ns := namespace.NewOrFail(t, ctx, namespace.Config{Prefix: "locality-multicluster"})
+
+			var client, bInA, bInB echo.Instance
+			builder := echo.NewBuilder(ctx)
+			builder.
+				With(&client, echoConfigInCluster(ns, "client", clusterA)).
+				With(&bInA, echoConfigInCluster(ns, "b", clusterA)).
+				With(&bInB, echoConfigInCluster(ns, "b", clusterB)).
+				BuildOrFail(t)
+
+			// ServiceB/ServiceC localities use the literal "region"/"closeregion"
+			// values the default failover rule (from: region, to: closeregion)
+			// matches on; the actual cluster placement of each backend is
+			// tracked separately via bInA/bInB.
+			se := serviceConfig{
+				Name:             "fake-service-multicluster",
+				Host:             "fake.service.multicluster.istio.io",
+				Namespace:        ns.Name(),
+				Resolution:       "STATIC",
+				ServiceBAddress:  bInA.Address(),
+				ServiceBLocality: "region/zone/subzone",
+				ServiceCAddress:  bInB.Address(),
+				ServiceCLocality: "closeregion/zone/subzone",
+			}
+			deploy(ctx, ns, se, client, map[string]LocalityEndpointExpectation{
+				"region/zone/subzone":      {Count: 1, Priority: 0},
+				"closeregion/zone/subzone": {Count: 1, Priority: 1},
+			})
+
+			// With the clusterA endpoint present, all traffic should stay
+			// in-cluster.
+			assertAllTrafficReachedCluster(t, client, se.Host, clusterA.Name())
+
+			// Eject the clusterA endpoint by removing it from the
+			// ServiceEntry entirely, rather than merely bouncing its
+			// sidecar, so EDS genuinely has zero hosts left at the
+			// "region" priority and must fail over to "closeregion".
+			se.ServiceBAddress = ""
+			deploy(ctx, ns, se, client, map[string]LocalityEndpointExpectation{
+				"closeregion/zone/subzone": {Count: 1, Priority: 0},
+			})
+
+			assertAllTrafficReachedCluster(t, client, se.Host, clusterB.Name())
+		})
+}